@@ -0,0 +1,255 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path"
+	"sync"
+)
+
+//-------------------------------------------------------------------------
+// PackageCache (implemented below by DiskCache and TieredCache)
+//-------------------------------------------------------------------------
+
+// MemoryCache is not a PackageCache: its Get and Put take only the import
+// path, and it is used as the front tier of TieredCache.
+//
+// Get and Put are keyed by import path, but srcPath is the resolved
+// filesystem path of the package's compiled archive or source (what the
+// walker actually reads) — that's what staleness is checked against,
+// since the import path itself isn't a filesystem path os.Stat can use.
+type PackageCache interface {
+	Get(importPath, srcPath string) (*PackageFile, bool)
+	Put(importPath, srcPath string, p *PackageFile)
+	Evict()
+}
+
+//-------------------------------------------------------------------------
+// MemoryCache (in-memory LRU)
+//-------------------------------------------------------------------------
+
+type memoryCacheEntry struct {
+	path string
+	pkg  *PackageFile
+}
+
+// MemoryCache is an in-memory LRU keyed by import path. maxEntries <= 0
+// means unbounded.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryCache) Get(path string) (*PackageFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[path]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*memoryCacheEntry).pkg, true
+}
+
+func (c *MemoryCache) Put(path string, p *PackageFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[path]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*memoryCacheEntry).pkg = p
+		return
+	}
+
+	c.items[path] = c.ll.PushFront(&memoryCacheEntry{path, p})
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		c.removeOldest()
+	}
+}
+
+func (c *MemoryCache) removeOldest() {
+	e := c.ll.Back()
+	if e == nil {
+		return
+	}
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*memoryCacheEntry).path)
+}
+
+func (c *MemoryCache) Evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// SetMaxEntries changes the LRU bound, evicting immediately if the cache
+// is over the new limit. This backs the "set" RPC's cache-size key.
+func (c *MemoryCache) SetMaxEntries(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxEntries = n
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		c.removeOldest()
+	}
+}
+
+//-------------------------------------------------------------------------
+// DiskCache (on-disk, under $XDG_CACHE_HOME/gocode)
+//-------------------------------------------------------------------------
+
+type diskCacheEntry struct {
+	Mtime int64
+	Size  int64
+	Pkg   *PackageFile
+}
+
+// DiskCache persists package files keyed by (import path, mtime, size),
+// so a stale entry is simply ignored rather than served.
+type DiskCache struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewDiskCache() *DiskCache {
+	c := &DiskCache{dir: cacheDir()}
+	os.MkdirAll(c.dir, 0755)
+	return c
+}
+
+func cacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return path.Join(dir, "gocode")
+	}
+	return path.Join(os.Getenv("HOME"), ".cache", "gocode")
+}
+
+// cacheKey turns an import path into a filesystem-safe cache filename.
+// Hashed rather than character-substituted, since e.g. "a/b_c" and
+// "a_b/c" would otherwise collide on a single replaced separator.
+func cacheKey(importPath string) string {
+	h := sha1.New()
+	io.WriteString(h, importPath)
+	return fmt.Sprintf("%x.cache", h.Sum())
+}
+
+func (c *DiskCache) Get(importPath, srcPath string) (*PackageFile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := ioutil.ReadFile(path.Join(c.dir, cacheKey(importPath)))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry diskCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+
+	fi, err := os.Stat(srcPath)
+	if err != nil || fi.Mtime_ns != entry.Mtime || fi.Size != entry.Size {
+		return nil, false
+	}
+	return entry.Pkg, true
+}
+
+func (c *DiskCache) Put(importPath, srcPath string, p *PackageFile) {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(&diskCacheEntry{fi.Mtime_ns, fi.Size, p})
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ioutil.WriteFile(path.Join(c.dir, cacheKey(importPath)), data, 0644)
+}
+
+func (c *DiskCache) Evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range entries {
+		os.Remove(path.Join(c.dir, fi.Name))
+	}
+}
+
+//-------------------------------------------------------------------------
+// TieredCache
+//
+// What the daemon actually holds: an in-memory LRU in front of the disk
+// store, so a cold start populates from disk instead of re-parsing the
+// stdlib, and repeated completions in one session never touch disk.
+//-------------------------------------------------------------------------
+
+const defaultMaxCacheEntries = 1000
+
+const cacheMaxEntriesKey = "max-cache-size"
+
+// pkgcache is the daemon's package cache, set up in serverFunc and
+// shared with RPCRemote and the HTTP handlers in the same process.
+var pkgcache *TieredCache
+
+type TieredCache struct {
+	mem  *MemoryCache
+	disk *DiskCache
+}
+
+func NewTieredCache(maxEntries int) *TieredCache {
+	return &TieredCache{
+		mem:  NewMemoryCache(maxEntries),
+		disk: NewDiskCache(),
+	}
+}
+
+func (c *TieredCache) Get(importPath, srcPath string) (*PackageFile, bool) {
+	if p, ok := c.mem.Get(importPath); ok {
+		return p, true
+	}
+	if p, ok := c.disk.Get(importPath, srcPath); ok {
+		c.mem.Put(importPath, p)
+		return p, true
+	}
+	return nil, false
+}
+
+func (c *TieredCache) Put(importPath, srcPath string, p *PackageFile) {
+	c.mem.Put(importPath, p)
+	c.disk.Put(importPath, srcPath, p)
+}
+
+func (c *TieredCache) Evict() {
+	c.mem.Evict()
+	c.disk.Evict()
+}
+
+func (c *TieredCache) SetMaxEntries(n int) {
+	c.mem.SetMaxEntries(n)
+}
@@ -12,44 +12,75 @@ import (
 	"fmt"
 	"os"
 	"json"
+	"bytes"
+	"code.google.com/p/goplan9/plan9/acme"
+	"http"
+	"os/signal"
+	"sync"
 )
 
+const shutdownTimeout = 5 * time.Second
+
 var (
-	server = flag.Bool("s", false, "run a server instead of a client")
-	format = flag.String("f", "nice", "output format (vim | emacs | nice | csv)")
-	input  = flag.String("in", "", "use this file instead of stdin input")
+	server   = flag.Bool("s", false, "run a server instead of a client")
+	format   = flag.String("f", "nice", "output format (vim | emacs | nice | csv | acme)")
+	input    = flag.String("in", "", "use this file instead of stdin input")
+	httpAddr = flag.String("http", "", "serve an unauthenticated HTTP/JSON RPC on this address instead of the unix socket (no host binds to 127.0.0.1; pass one explicitly to expose it beyond localhost)")
 )
 
 //-------------------------------------------------------------------------
 // Formatter interface
 //-------------------------------------------------------------------------
 
+// Formatter streams candidates one at a time: BeginCandidates(num),
+// where num is the partial match length, then WriteCandidate per
+// candidate, then EndCandidates.
 type Formatter interface {
 	WriteEmpty()
-	WriteCandidates(names, types, classes []string, num int)
+	BeginCandidates(num int)
+	WriteCandidate(name, typ, class string)
+	EndCandidates()
 	WriteSMap(decldescs []DeclDesc)
 	WriteRename(renamedescs []RenameDesc, err string)
 }
 
+// Candidate is a single completion entry as streamed from the server.
+type Candidate struct {
+	Name  string
+	Type  string
+	Class string
+}
+
 //-------------------------------------------------------------------------
 // NiceFormatter (just for testing, simple textual output)
 //-------------------------------------------------------------------------
 
-type NiceFormatter struct{}
+type NiceFormatter struct {
+	buf   bytes.Buffer
+	count int
+}
 
 func (*NiceFormatter) WriteEmpty() {
 	fmt.Printf("Nothing to complete.\n")
 }
 
-func (*NiceFormatter) WriteCandidates(names, types, classes []string, num int) {
-	fmt.Printf("Found %d candidates:\n", len(names))
-	for i := 0; i < len(names); i++ {
-		abbr := fmt.Sprintf("%s %s %s", classes[i], names[i], types[i])
-		if classes[i] == "func" {
-			abbr = fmt.Sprintf("%s %s%s", classes[i], names[i], types[i][len("func"):])
-		}
-		fmt.Printf("  %s\n", abbr)
+func (f *NiceFormatter) BeginCandidates(num int) {
+	f.buf.Reset()
+	f.count = 0
+}
+
+func (f *NiceFormatter) WriteCandidate(name, typ, class string) {
+	f.count++
+	abbr := fmt.Sprintf("%s %s %s", class, name, typ)
+	if class == "func" {
+		abbr = fmt.Sprintf("%s %s%s", class, name, typ[len("func"):])
 	}
+	fmt.Fprintf(&f.buf, "  %s\n", abbr)
+}
+
+func (f *NiceFormatter) EndCandidates() {
+	fmt.Printf("Found %d candidates:\n", f.count)
+	f.buf.WriteTo(os.Stdout)
 }
 
 func (*NiceFormatter) WriteSMap(decldescs []DeclDesc) {
@@ -72,30 +103,38 @@ func (*NiceFormatter) WriteRename(renamedescs []RenameDesc, err string) {
 // VimFormatter
 //-------------------------------------------------------------------------
 
-type VimFormatter struct{}
+type VimFormatter struct {
+	first bool
+}
 
 func (*VimFormatter) WriteEmpty() {
 	fmt.Print("[0, []]")
 }
 
-func (*VimFormatter) WriteCandidates(names, types, classes []string, num int) {
+func (f *VimFormatter) BeginCandidates(num int) {
 	fmt.Printf("[%d, [", num)
-	for i := 0; i < len(names); i++ {
-		word := names[i]
-		if classes[i] == "func" {
-			word += "("
-		}
+	f.first = true
+}
 
-		abbr := fmt.Sprintf("%s %s %s", classes[i], names[i], types[i])
-		if classes[i] == "func" {
-			abbr = fmt.Sprintf("%s %s%s", classes[i], names[i], types[i][len("func"):])
-		}
-		fmt.Printf("{'word': '%s', 'abbr': '%s'}", word, abbr)
-		if i != len(names)-1 {
-			fmt.Printf(", ")
-		}
+func (f *VimFormatter) WriteCandidate(name, typ, class string) {
+	word := name
+	if class == "func" {
+		word += "("
+	}
 
+	abbr := fmt.Sprintf("%s %s %s", class, name, typ)
+	if class == "func" {
+		abbr = fmt.Sprintf("%s %s%s", class, name, typ[len("func"):])
 	}
+
+	if !f.first {
+		fmt.Printf(", ")
+	}
+	f.first = false
+	fmt.Printf("{'word': '%s', 'abbr': '%s'}", word, abbr)
+}
+
+func (*VimFormatter) EndCandidates() {
 	fmt.Printf("]]")
 }
 
@@ -144,15 +183,18 @@ type EmacsFormatter struct{}
 func (*EmacsFormatter) WriteEmpty() {
 }
 
-func (*EmacsFormatter) WriteCandidates(names, types, classes []string, num int) {
-	for i := 0; i < len(names); i++ {
-		name := names[i]
-		hint := classes[i] + " " + types[i]
-		if classes[i] == "func" {
-			hint = types[i]
-		}
-		fmt.Printf("%s,,%s\n", name, hint)
+func (*EmacsFormatter) BeginCandidates(num int) {
+}
+
+func (*EmacsFormatter) WriteCandidate(name, typ, class string) {
+	hint := class + " " + typ
+	if class == "func" {
+		hint = typ
 	}
+	fmt.Printf("%s,,%s\n", name, hint)
+}
+
+func (*EmacsFormatter) EndCandidates() {
 }
 
 func (*EmacsFormatter) WriteSMap(decldescs []DeclDesc) {
@@ -170,10 +212,14 @@ type CSVFormatter struct{}
 func (*CSVFormatter) WriteEmpty() {
 }
 
-func (*CSVFormatter) WriteCandidates(names, types, classes []string, num int) {
-	for i := 0; i < len(names); i++ {
-		fmt.Printf("%s,,%s,,%s\n", classes[i], names[i], types[i])
-	}
+func (*CSVFormatter) BeginCandidates(num int) {
+}
+
+func (*CSVFormatter) WriteCandidate(name, typ, class string) {
+	fmt.Printf("%s,,%s,,%s\n", class, name, typ)
+}
+
+func (*CSVFormatter) EndCandidates() {
 }
 
 func (*CSVFormatter) WriteSMap(decldescs []DeclDesc) {
@@ -182,6 +228,74 @@ func (*CSVFormatter) WriteSMap(decldescs []DeclDesc) {
 func (*CSVFormatter) WriteRename(renamedescs []RenameDesc, err string) {
 }
 
+//-------------------------------------------------------------------------
+// AcmeFormatter
+//-------------------------------------------------------------------------
+
+// AcmeFormatter writes candidates into a Plan 9 acme window instead of
+// stdout. When id is non-zero it reuses the window allocated by the
+// server for this client (see RPC_setid), otherwise it opens a fresh one
+// named "<filename>+completions".
+type AcmeFormatter struct {
+	filename string
+	id       int
+	win      *acme.Win
+	buf      bytes.Buffer
+	count    int
+}
+
+func (f *AcmeFormatter) WriteEmpty() {
+	f.show([]byte("Nothing to complete.\n"))
+}
+
+func (f *AcmeFormatter) BeginCandidates(num int) {
+	f.buf.Reset()
+	f.count = 0
+}
+
+func (f *AcmeFormatter) WriteCandidate(name, typ, class string) {
+	f.count++
+	abbr := fmt.Sprintf("%s %s %s", class, name, typ)
+	if class == "func" {
+		abbr = fmt.Sprintf("%s %s%s", class, name, typ[len("func"):])
+	}
+	fmt.Fprintf(&f.buf, "  %s\n", abbr)
+}
+
+func (f *AcmeFormatter) EndCandidates() {
+	header := fmt.Sprintf("Found %d candidates:\n", f.count)
+	f.show(append([]byte(header), f.buf.Bytes()...))
+}
+
+func (f *AcmeFormatter) WriteSMap(decldescs []DeclDesc) {
+}
+
+func (f *AcmeFormatter) WriteRename(renamedescs []RenameDesc, err string) {
+}
+
+// show replaces the body of the completion window with data, opening or
+// creating the window on first use.
+func (f *AcmeFormatter) show(data []byte) {
+	win := f.win
+	if win == nil {
+		var err os.Error
+		if f.id != 0 {
+			win, err = acme.Open(f.id, nil)
+		}
+		if win == nil {
+			win, err = acme.New()
+			if err != nil {
+				panic(err.String())
+			}
+			win.Name("%s+completions", f.filename)
+			f.id = win.ID()
+		}
+		f.win = win
+	}
+	win.Clear()
+	win.Write("data", data)
+}
+
 //-------------------------------------------------------------------------
 
 func getFormatter() Formatter {
@@ -194,6 +308,8 @@ func getFormatter() Formatter {
 		return new(NiceFormatter)
 	case "csv":
 		return new(CSVFormatter)
+	case "acme":
+		return new(AcmeFormatter)
 	}
 	return new(VimFormatter)
 }
@@ -214,23 +330,220 @@ func fileExists(filename string) bool {
 	return true
 }
 
+// loopbackUnlessHostGiven binds "-http" to 127.0.0.1 when addr is just
+// a port (e.g. ":9090"), so it isn't accidentally exposed on every
+// interface; an explicit host in addr is left alone.
+func loopbackUnlessHostGiven(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "127.0.0.1" + addr
+	}
+	return addr
+}
+
 func serverFunc() int {
 	readConfig(&Config)
+	pkgcache = NewTieredCache(defaultMaxCacheEntries)
+
+	if *httpAddr != "" {
+		daemon = NewDaemon("", pkgcache)
+		registerHTTPHandlers()
+		installSignalHandlers("")
+		err := http.ListenAndServe(loopbackUnlessHostGiven(*httpAddr), nil)
+		if err != nil {
+			fmt.Printf("%s\n", err.String())
+			return 1
+		}
+		return 0
+	}
+
 	socketfname := getSocketFilename()
 	if fileExists(socketfname) {
 		fmt.Printf("unix socket: '%s' already exists\n", socketfname)
 		return 1
 	}
-	daemon = NewDaemon(socketfname)
+	daemon = NewDaemon(socketfname, pkgcache)
 	defer os.Remove(socketfname)
 
 	rpcremote := new(RPCRemote)
 	rpc.Register(rpcremote)
 
+	installSignalHandlers(socketfname)
+
 	daemon.acr.Loop()
 	return 0
 }
 
+// installSignalHandlers reloads the config on SIGHUP and shuts down
+// gracefully on SIGTERM/SIGINT. socketfname is "" in HTTP mode.
+func installSignalHandlers(socketfname string) {
+	go func() {
+		for sig := range signal.Incoming {
+			switch sig.(os.UnixSignal) {
+			case os.SIGHUP:
+				reloadConfig()
+			case os.SIGTERM, os.SIGINT:
+				gracefulShutdown(socketfname)
+			}
+		}
+	}()
+}
+
+// reloadConfig re-reads the config file and applies it to the daemon.
+func reloadConfig() {
+	readConfig(&Config)
+	daemon.ReloadConfig(&Config)
+}
+
+// gracefulShutdown waits up to shutdownTimeout for in-flight calls to
+// finish, then removes the socket file (if any) and exits.
+func gracefulShutdown(socketfname string) {
+	daemon.Shutdown(shutdownTimeout)
+	if socketfname != "" {
+		os.Remove(socketfname)
+	}
+	os.Exit(0)
+}
+
+//-------------------------------------------------------------------------
+// HTTP/JSON RPC transport (alternative to the unix-socket net/rpc server)
+//-------------------------------------------------------------------------
+
+type httpAutoCompleteRequest struct {
+	File     []byte
+	Filename string
+	Cursor   int
+}
+
+type httpAutoCompleteResponse struct {
+	Names   []string
+	Types   []string
+	Classes []string
+	Partial int
+}
+
+type httpSMapRequest struct {
+	Filename string
+}
+
+type httpSMapResponse struct {
+	Decls []DeclDesc
+}
+
+type httpRenameRequest struct {
+	Filename string
+	Cursor   int
+}
+
+type httpRenameResponse struct {
+	Decls []RenameDesc
+	Error string
+}
+
+type httpStatusResponse struct {
+	Status string
+}
+
+type httpSetRequest struct {
+	Key   string
+	Value string
+}
+
+type httpSetResponse struct {
+	Result string
+}
+
+type httpOKResponse struct {
+	OK bool
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.String(), 500)
+		return
+	}
+	w.Write(data)
+}
+
+func readJSON(r *http.Request, v interface{}) os.Error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func httpAutoComplete(w http.ResponseWriter, r *http.Request) {
+	var in httpAutoCompleteRequest
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, err.String(), 400)
+		return
+	}
+	candidates, partial := daemon.AutoComplete(in.File, in.Filename, in.Cursor)
+	var names, types, classes []string
+	for cand := range candidates {
+		names = append(names, cand.Name)
+		types = append(types, cand.Type)
+		classes = append(classes, cand.Class)
+	}
+	writeJSON(w, &httpAutoCompleteResponse{names, types, classes, partial})
+}
+
+func httpSMap(w http.ResponseWriter, r *http.Request) {
+	var in httpSMapRequest
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, err.String(), 400)
+		return
+	}
+	writeJSON(w, &httpSMapResponse{daemon.SMap(in.Filename)})
+}
+
+func httpRename(w http.ResponseWriter, r *http.Request) {
+	var in httpRenameRequest
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, err.String(), 400)
+		return
+	}
+	decls, errstr := daemon.Rename(in.Filename, in.Cursor)
+	writeJSON(w, &httpRenameResponse{decls, errstr})
+}
+
+func httpStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &httpStatusResponse{daemon.Status()})
+}
+
+func httpSet(w http.ResponseWriter, r *http.Request) {
+	var in httpSetRequest
+	if err := readJSON(r, &in); err != nil {
+		http.Error(w, err.String(), 400)
+		return
+	}
+	// daemon.Set applies max-cache-size to pkgcache itself (it was handed
+	// the same pkgcache in NewDaemon), so this behaves identically over
+	// RPCRemote and HTTP instead of the HTTP handler special-casing it.
+	writeJSON(w, &httpSetResponse{daemon.Set(in.Key, in.Value)})
+}
+
+func httpDropCache(w http.ResponseWriter, r *http.Request) {
+	daemon.DropCache()
+	writeJSON(w, &httpOKResponse{true})
+}
+
+func httpClose(w http.ResponseWriter, r *http.Request) {
+	daemon.Close()
+	writeJSON(w, &httpOKResponse{true})
+}
+
+func registerHTTPHandlers() {
+	http.HandleFunc("/autocomplete", httpAutoComplete)
+	http.HandleFunc("/smap", httpSMap)
+	http.HandleFunc("/rename", httpRename)
+	http.HandleFunc("/status", httpStatus)
+	http.HandleFunc("/set", httpSet)
+	http.HandleFunc("/drop-cache", httpDropCache)
+	http.HandleFunc("/close", httpClose)
+}
+
 func cmdStatus(c *rpc.Client) {
 	fmt.Printf("%s\n", Client_Status(c, 0))
 }
@@ -266,13 +579,66 @@ func cmdAutoComplete(c *rpc.Client) {
 	}
 
 	formatter := getFormatter()
-	names, types, classes, partial := Client_AutoComplete(c, file, filename, cursor)
-	if names == nil {
+	candidates, partial := Client_AutoComplete(c, file, filename, cursor)
+	if candidates == nil {
+		formatter.WriteEmpty()
+		return
+	}
+
+	formatter.BeginCandidates(partial)
+	for cand := range candidates {
+		formatter.WriteCandidate(cand.Name, cand.Type, cand.Class)
+	}
+	formatter.EndCandidates()
+}
+
+// cmdAcmeComplete is like cmdAutoComplete, but it feeds the candidates to
+// a persistent acme window instead of stdout. The window id is allocated
+// by the server (RPC_setid) and reused across invocations so the same
+// completion pane gets updated in place rather than spawning a new one
+// every time.
+func cmdAcmeComplete(c *rpc.Client) {
+	var file []byte
+	var err os.Error
+
+	if *input != "" {
+		file, err = ioutil.ReadFile(*input)
+	} else {
+		file, err = ioutil.ReadAll(os.Stdin)
+	}
+
+	if err != nil {
+		panic(err.String())
+	}
+
+	filename := ""
+	cursor := -1
+
+	switch flag.NArg() {
+	case 2:
+		cursor, _ = strconv.Atoi(flag.Arg(1))
+	case 3:
+		filename = flag.Arg(1)
+		cursor, _ = strconv.Atoi(flag.Arg(2))
+	}
+
+	if filename != "" && filename[0] != '/' {
+		cwd, _ := os.Getwd()
+		filename = path.Join(cwd, filename)
+	}
+
+	formatter := &AcmeFormatter{filename: filename, id: Client_SetID(c, filename)}
+	candidates, partial := Client_AutoComplete(c, file, filename, cursor)
+	if candidates == nil {
 		formatter.WriteEmpty()
 		return
 	}
 
-	formatter.WriteCandidates(names, types, classes, partial)
+	formatter.BeginCandidates(partial)
+	for cand := range candidates {
+		formatter.WriteCandidate(cand.Name, cand.Type, cand.Class)
+	}
+	formatter.EndCandidates()
 }
 
 func cmdSMap(c *rpc.Client) {
@@ -331,6 +697,47 @@ func cmdSet(c *rpc.Client) {
 	}
 }
 
+// Client_SetID asks the server to allocate (or return the existing) acme
+// window id for filename. Passing the same filename on a later
+// invocation yields the same id, which is how cmdAcmeComplete updates
+// one completion window in place instead of opening a new one every
+// time.
+func Client_SetID(c *rpc.Client, filename string) int {
+	var reply int
+	if err := c.Call("RPCRemote.SetID", filename, &reply); err != nil {
+		fmt.Printf("%s\n", err.String())
+		return 0
+	}
+	return reply
+}
+
+// acmeIDs allocates acme window ids per filename (each acme-complete
+// call is a fresh connection, so this can't be keyed by conn).
+var acmeIDs = struct {
+	mu     sync.Mutex
+	next   int
+	byFile map[string]int
+}{byFile: make(map[string]int)}
+
+func allocAcmeID(filename string) int {
+	acmeIDs.mu.Lock()
+	defer acmeIDs.mu.Unlock()
+
+	if id, ok := acmeIDs.byFile[filename]; ok {
+		return id
+	}
+	acmeIDs.next++
+	acmeIDs.byFile[filename] = acmeIDs.next
+	return acmeIDs.next
+}
+
+// SetID is the RPC_setid call: it returns the acme window id for
+// filename, allocating one on first use.
+func (r *RPCRemote) SetID(filename string, reply *int) os.Error {
+	*reply = allocAcmeID(filename)
+	return nil
+}
+
 func makeFDs() ([]*os.File, os.Error) {
 	var fds [3]*os.File
 	var err os.Error
@@ -410,6 +817,8 @@ func clientFunc() int {
 		switch flag.Arg(0) {
 		case "autocomplete":
 			cmdAutoComplete(client)
+		case "acme-complete":
+			cmdAcmeComplete(client)
 		case "close":
 			cmdClose(client)
 		case "status":